@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+//ruleBytes tracks bytes transferred per rule since start, indexed like Rules.Rules.
+var ruleBytes []int64
+
+//ruleCancels stops a rule's listener goroutine when cancelled, indexed like Rules.Rules.
+var ruleCancels []context.CancelFunc
+
+//ruleRemoved tombstones a rule deleted through the admin API. Slots are kept
+//(never compacted) so every other per-rule slice keeps the index that
+//already-running goroutines were handed; removed rules are just hidden from
+//GET /rules and left out when the config is saved.
+var ruleRemoved []bool
+
+type ruleStats struct {
+	Name                    string `json:"name"`
+	Listen                  uint16 `json:"listen"`
+	Forward                 string `json:"forward"`
+	QuotaRemaining          int64  `json:"quota_remaining"`
+	ExpireDate              int64  `json:"expire_date"`
+	SimultaneousConnections int    `json:"simultaneous_connections"`
+	BytesTransferred        int64  `json:"bytes_transferred"`
+}
+
+//startAdminServer serves the JSON admin API on AppConfig.AdminListen. Every
+//request must present AppConfig.AdminToken as a bearer token.
+func startAdminServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rules", adminAuth(handleRules))
+	mux.HandleFunc("/rules/", adminAuth(handleRuleByName))
+	mux.HandleFunc("/save", adminAuth(handleSave))
+
+	log.Println("Admin API listening on", AppConfig.AdminListen)
+	if err := http.ListenAndServe(AppConfig.AdminListen, mux); err != nil {
+		logVerbose(1, "Admin API stopped:", err.Error())
+	}
+}
+
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token != AppConfig.AdminToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func handleRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		Rules.mu.RLock()
+		SimultaneousConnections.mu.RLock()
+		stats := make([]ruleStats, 0, len(Rules.Rules))
+		for i, rule := range Rules.Rules {
+			if i < len(ruleRemoved) && ruleRemoved[i] {
+				continue
+			}
+			stats = append(stats, ruleStats{
+				Name:                    rule.Name,
+				Listen:                  rule.Listen,
+				Forward:                 rule.Forward,
+				QuotaRemaining:          rule.Quota,
+				ExpireDate:              rule.ExpireDate,
+				SimultaneousConnections: SimultaneousConnections.SimultaneousConnections[i] / 2,
+				BytesTransferred:        atomic.LoadInt64(&ruleBytes[i]),
+			})
+		}
+		SimultaneousConnections.mu.RUnlock()
+		Rules.mu.RUnlock()
+		_ = json.NewEncoder(w).Encode(stats)
+	case http.MethodPost:
+		var rule Rule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		addRule(rule)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleRuleByName(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/rules/")
+	if name == "" {
+		http.Error(w, "missing rule name", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		if !removeRule(name) {
+			http.Error(w, "rule not found", http.StatusNotFound)
+		}
+	case http.MethodPatch:
+		var patch rulePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !patchRule(name, patch) {
+			http.Error(w, "rule not found", http.StatusNotFound)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	saveConfig()
+}
+
+//addRule appends a new rule and starts its listener goroutine. All six
+//per-rule slices (Rules.Rules and the five below) are grown together under
+//Rules.mu so a racing GET /rules never observes Rules.Rules grown without a
+//matching slot in the others.
+func addRule(rule Rule) {
+	Rules.mu.Lock()
+	index := len(Rules.Rules)
+	Rules.Rules = append(Rules.Rules, rule)
+	RuleLimiters = append(RuleLimiters, newRuleLimiter(rule))
+	ruleBytes = append(ruleBytes, 0)
+	ruleRemoved = append(ruleRemoved, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	ruleCancels = append(ruleCancels, cancel)
+
+	SimultaneousConnections.mu.Lock()
+	SimultaneousConnections.SimultaneousConnections = append(SimultaneousConnections.SimultaneousConnections, 0)
+	SimultaneousConnections.mu.Unlock()
+	Rules.mu.Unlock()
+
+	warnIfProtocolUnrecognized(rule)
+	if ruleWantsTCP(rule) {
+		go startRule(ctx, index, rule)
+	}
+	if ruleWantsUDP(rule) {
+		go startUDPRule(ctx, index, rule)
+	}
+}
+
+//findRuleIndex returns the index of the first non-removed rule named name, or -1.
+func findRuleIndex(name string) int {
+	for i, rule := range Rules.Rules {
+		if rule.Name == name && (i >= len(ruleRemoved) || !ruleRemoved[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+func removeRule(name string) bool {
+	Rules.mu.Lock()
+	index := findRuleIndex(name)
+	if index == -1 {
+		Rules.mu.Unlock()
+		return false
+	}
+	ruleRemoved[index] = true
+	cancel := ruleCancels[index]
+	Rules.mu.Unlock()
+
+	cancel()
+	return true
+}
+
+type rulePatch = struct {
+	Quota          *int64 `json:"quota"`
+	ExpireDate     *int64 `json:"expire_date"`
+	Simultaneous   *int   `json:"simultaneous"`
+	BandwidthLimit *int64 `json:"bandwidth_limit"`
+	BandwidthBurst *int   `json:"bandwidth_burst"`
+}
+
+//patchRule updates quota/expiry/simultaneous/bandwidth limits in place,
+//without stopping and restarting the rule's listener.
+func patchRule(name string, patch rulePatch) bool {
+	Rules.mu.Lock()
+	index := findRuleIndex(name)
+	if index == -1 {
+		Rules.mu.Unlock()
+		return false
+	}
+	if patch.Quota != nil {
+		Rules.Rules[index].Quota = *patch.Quota
+	}
+	if patch.ExpireDate != nil {
+		Rules.Rules[index].ExpireDate = *patch.ExpireDate
+	}
+	if patch.Simultaneous != nil {
+		Rules.Rules[index].Simultaneous = *patch.Simultaneous
+	}
+	if patch.BandwidthLimit != nil {
+		Rules.Rules[index].BandwidthLimit = *patch.BandwidthLimit
+	}
+	if patch.BandwidthBurst != nil {
+		Rules.Rules[index].BandwidthBurst = *patch.BandwidthBurst
+	}
+	RuleLimiters[index] = newRuleLimiter(Rules.Rules[index])
+	Rules.mu.Unlock()
+
+	return true
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -13,8 +15,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 //More global values
@@ -37,23 +42,52 @@ type CSafeRule struct {
 }
 
 type Rule struct {
-	Name         string
-	Listen       uint16
-	Forward      string
-	Quota        int64
-	ExpireDate   int64
-	Simultaneous int
+	Name           string
+	Listen         uint16
+	Forward        string
+	Quota          int64
+	ExpireDate     int64
+	Simultaneous   int
+	BandwidthLimit int64 // Bytes/sec; 0 means unlimited
+	BandwidthBurst int   // Burst size in bytes; 0 defaults to BandwidthLimit
+	Protocol       string // "tcp" (default, empty also means tcp), "udp" or "both"
+
+	SendProxyProtocol   string // "", "v1" or "v2": emit a PROXY protocol header to Forward identifying the real client
+	AcceptProxyProtocol bool   // Expect and strip a PROXY protocol header from every accepted connection
+
+	TLSCert string // Path to a PEM certificate; set together with TLSKey to terminate TLS and forward cleartext to Forward
+	TLSKey  string // Path to the PEM private key matching TLSCert
+
+	SNIRoutes      map[string]string // Server name -> "host:port" backend, routed without decrypting
+	DefaultForward string            // Backend used when SNIRoutes has no match for the ClientHello's server name
 }
 type Config struct {
-	SaveDuration int
-	Timeout      int64
-	Rules        []Rule
+	SaveDuration   int
+	Timeout        int64
+	BandwidthLimit int64 // Aggregate bytes/sec across all rules; 0 means unlimited
+	Rules          []Rule
+
+	Mode          string // "direct" (default), "server" or "client"
+	ServerAddress string // Client mode: address of the server to dial
+	ControlPort   int    // Server mode: port to accept control/data connections on; client mode: port to dial
+	Secret        string // Shared secret used to authenticate the control handshake
+
+	AdminListen string // Address for the admin HTTP API to listen on, e.g. ":8081"; empty disables it
+	AdminToken  string // Bearer token the admin API requires on every request
 }
 
+//AppConfig holds the config-level settings so code outside main, such as
+//the admin API, can reach them. Its Rules field is only the set loaded at
+//startup; the live rules are in Rules.Rules, which saveConfig writes instead.
+var AppConfig Config
+
 //Timeout values
 var EnableTimeOut = true
 var TimeoutDuration time.Duration
 
+//Mode holds the active operation mode: ModeDirect, ModeServer or ModeClient
+var Mode = ModeDirect
+
 func main() {
 	{ //Parse arguments
 		flag.StringVar(&ConfigFileName, "config", "rules.json", "The config filename")
@@ -92,6 +126,21 @@ func main() {
 
 		Rules.Rules = conf.Rules
 		SimultaneousConnections.SimultaneousConnections = make([]int, len(Rules.Rules))
+		RuleLimiters = make([]*rate.Limiter, len(Rules.Rules))
+		ruleBytes = make([]int64, len(Rules.Rules))
+		ruleRemoved = make([]bool, len(Rules.Rules))
+		ruleCancels = make([]context.CancelFunc, len(Rules.Rules))
+		for i, rule := range Rules.Rules {
+			RuleLimiters[i] = newRuleLimiter(rule)
+		}
+		if conf.BandwidthLimit > 0 {
+			GlobalLimiter = rate.NewLimiter(rate.Limit(conf.BandwidthLimit), int(conf.BandwidthLimit))
+		}
+		if conf.Mode == "" {
+			conf.Mode = ModeDirect
+		}
+		Mode = conf.Mode
+		AppConfig = conf
 		if conf.Timeout == -1 {
 			logVerbose(1, "Disabled timeout")
 			EnableTimeOut = false
@@ -101,56 +150,34 @@ func main() {
 		}
 	}
 
-	//Start listeners
-	for index, rule := range Rules.Rules {
-		go func(i int, loopRule Rule) {
-			if loopRule.Quota < 0 { //If the quota is already reached why listen for connections?
-				log.Println("Skip enabling forward on port", loopRule.Listen, "because the quota is reached.")
-				return
-			}
-			if loopRule.ExpireDate != 0 && loopRule.ExpireDate < time.Now().Unix() {
-				log.Println("Skip enabling forward on port", loopRule.Listen, "because this rule is expired.")
-				return
-			}
-
-			log.Println("Forwarding from", loopRule.Listen, "port to", loopRule.Forward)
-			ln, err := net.Listen("tcp", ":"+strconv.Itoa(int(loopRule.Listen))) //Listen on port
-			if err != nil {
-				panic(err)
-			}
-
-			for {
-				conn, err := ln.Accept() //The loop will be held here
-
-				Rules.mu.RLock()              //Lock the mutex to just read the quota
-				if Rules.Rules[i].Quota < 0 { //Check the quota
-					Rules.mu.RUnlock()
-					logVerbose(1, "Quota reached for port", loopRule.Listen, "pointing to", loopRule.Forward)
-					if err == nil {
-						_ = conn.Close()
-					}
-					saveConfig(conf)
-					break
-				}
-				if Rules.Rules[i].ExpireDate != 0 && Rules.Rules[i].ExpireDate < time.Now().Unix() {
-					Rules.mu.RUnlock()
-					logVerbose(1, "Expire date reached for port", loopRule.Listen, "pointing to", loopRule.Forward)
-					if err == nil {
-						_ = conn.Close()
-					}
-					saveConfig(conf)
-					break
-				}
-				Rules.mu.RUnlock()
+	//Admin API for live rule management and stats
+	if AppConfig.AdminListen != "" {
+		go startAdminServer()
+	}
 
-				if err != nil {
-					println("Error on accepting connection:", err.Error())
-					continue
-				}
+	//In client mode we don't listen for public traffic ourselves; we dial the
+	//server's control port and wait to be told when to connect locally.
+	if Mode == ModeClient {
+		go startTunnelClient(conf)
+	} else {
+		//In server mode, a second listener accepts control/data connections
+		//from clients so visitor traffic on Rule.Listen can be relayed to them.
+		if Mode == ModeServer {
+			go startTunnelServer(conf)
+		}
 
-				go handleRequest(conn, i, loopRule)
+		//Start listeners
+		for index, rule := range Rules.Rules {
+			ctx, cancel := context.WithCancel(context.Background())
+			ruleCancels[index] = cancel
+			warnIfProtocolUnrecognized(rule)
+			if ruleWantsTCP(rule) {
+				go startRule(ctx, index, rule)
+			}
+			if ruleWantsUDP(rule) {
+				go startUDPRule(ctx, index, rule)
 			}
-		}(index, rule)
+		}
 	}
 
 	//Save config file
@@ -158,11 +185,11 @@ func main() {
 		sd := conf.SaveDuration
 		if sd == 0 {
 			sd = 600
-			conf.SaveDuration = 600
+			AppConfig.SaveDuration = 600
 		}
 		for {
 			time.Sleep(time.Duration(sd) * time.Second) //Save file every x seconds
-			saveConfig(conf)
+			saveConfig()
 		}
 	}()
 
@@ -177,14 +204,142 @@ func main() {
 	log.Println("Ctrl + C to stop")
 	<-done
 	if SaveBeforeExit {
-		saveConfig(conf) //Save the config file one last time before exiting
+		saveConfig() //Save the config file one last time before exiting
 	}
 	log.Println("Exiting")
 }
 
-func saveConfig(config Config) {
+//startRule listens on rule.Listen and hands accepted connections to
+//handleRequest until ctx is cancelled, which lets the admin API stop a
+//single rule's listener without touching the others.
+func startRule(ctx context.Context, index int, rule Rule) {
+	if rule.Quota < 0 { //If the quota is already reached why listen for connections?
+		log.Println("Skip enabling forward on port", rule.Listen, "because the quota is reached.")
+		return
+	}
+	if rule.ExpireDate != 0 && rule.ExpireDate < time.Now().Unix() {
+		log.Println("Skip enabling forward on port", rule.Listen, "because this rule is expired.")
+		return
+	}
+
+	log.Println("Forwarding from", rule.Listen, "port to", rule.Forward)
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(int(rule.Listen))) //Listen on port
+	if err != nil {
+		logVerbose(1, "Error starting listener for rule", rule.Name, ":", err.Error())
+		return
+	}
+
+	var tlsConfig *tls.Config
+	if rule.TLSCert != "" && rule.TLSKey != "" {
+		tlsConfig, err = loadRuleTLSConfig(rule)
+		if err != nil {
+			logVerbose(1, "Error loading TLS certificate for rule", rule.Name, ":", err.Error())
+			return
+		}
+	}
+
+	go func() { //Closing the listener is what makes Accept below return once ctx is cancelled
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept() //The loop will be held here
+
+		Rules.mu.RLock()                  //Lock the mutex to just read the quota
+		if Rules.Rules[index].Quota < 0 { //Check the quota
+			Rules.mu.RUnlock()
+			logVerbose(1, "Quota reached for port", rule.Listen, "pointing to", rule.Forward)
+			if err == nil {
+				_ = conn.Close()
+			}
+			saveConfig()
+			return
+		}
+		if Rules.Rules[index].ExpireDate != 0 && Rules.Rules[index].ExpireDate < time.Now().Unix() {
+			Rules.mu.RUnlock()
+			logVerbose(1, "Expire date reached for port", rule.Listen, "pointing to", rule.Forward)
+			if err == nil {
+				_ = conn.Close()
+			}
+			saveConfig()
+			return
+		}
+		Rules.mu.RUnlock()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return //Listener was stopped on purpose, e.g. DELETE through the admin API
+			}
+			println("Error on accepting connection:", err.Error())
+			continue
+		}
+
+		go finishAccept(conn, index, rule, tlsConfig)
+	}
+}
+
+//headerReadTimeout bounds how long finishAccept may block on a PROXY
+//protocol header or a ClientHello before giving up on a connection. Without
+//it, a client that opens the socket and never sends the header would hang
+//forever; since finishAccept already runs off the accept loop in its own
+//goroutine, that only ties up one connection instead of the whole listener.
+const headerReadTimeout = 10 * time.Second
+
+//finishAccept resolves everything startRule's accept loop itself must not
+//block on, namely the PROXY protocol header and SNI-based routing, then
+//hands the connection to handleRequest. It runs in its own goroutine per
+//connection so a slow or silent client only stalls its own connection.
+func finishAccept(conn net.Conn, index int, rule Rule, tlsConfig *tls.Config) {
+	needsHeaderParse := rule.AcceptProxyProtocol || len(rule.SNIRoutes) > 0
+	if needsHeaderParse {
+		_ = conn.SetReadDeadline(time.Now().Add(headerReadTimeout))
+	}
+
+	if rule.AcceptProxyProtocol {
+		var err error
+		conn, err = acceptProxyProtocolHeader(conn)
+		if err != nil {
+			logVerbose(1, "Error reading PROXY protocol header on port", rule.Listen, ":", err.Error())
+			return
+		}
+	}
+
+	forwardRule := rule
+	Rules.mu.RLock()
+	forwardRule.Simultaneous = Rules.Rules[index].Simultaneous //rule is the listener's startup copy; read the live limit so PATCH applies
+	Rules.mu.RUnlock()
+	if len(rule.SNIRoutes) > 0 {
+		routedConn, forward, err := resolveSNIRoute(conn, rule)
+		if err != nil {
+			logVerbose(1, "Error routing SNI connection on port", rule.Listen, ":", err.Error())
+			return
+		}
+		conn = routedConn
+		forwardRule.Forward = forward
+	}
+
+	if needsHeaderParse {
+		_ = conn.SetReadDeadline(time.Time{}) //Clear it; handleRequest/copyBuffer manage their own deadlines from here
+	}
+
+	if tlsConfig != nil {
+		conn = tls.Server(conn, tlsConfig)
+	}
+
+	handleRequest(conn, index, forwardRule)
+}
+
+func saveConfig() {
 	Rules.mu.RLock() //Lock to read the rules
-	config.Rules = Rules.Rules
+	config := AppConfig
+	config.Rules = make([]Rule, 0, len(Rules.Rules))
+	for i, rule := range Rules.Rules {
+		if i < len(ruleRemoved) && ruleRemoved[i] {
+			continue //Rules removed through the admin API are dropped instead of persisted
+		}
+		config.Rules = append(config.Rules, rule)
+	}
 	b, _ := json.Marshal(config)
 	Rules.mu.RUnlock()
 
@@ -207,34 +362,50 @@ func handleRequest(conn net.Conn, index int, r Rule) {
 	}
 	SimultaneousConnections.mu.RUnlock()
 
-	proxy, err := net.Dial("tcp", r.Forward) //Open a connection to remote host
+	var proxy net.Conn
+	var err error
+	if Mode == ModeServer {
+		proxy, err = Tunnel.requestConnection(r.Name) //Ask the client behind NAT to dial back
+	} else {
+		proxy, err = net.Dial("tcp", r.Forward) //Open a connection to remote host
+	}
 	if err != nil {
 		logVerbose(1, "Error on dialing remote host:", err.Error())
 		_ = conn.Close()
 		return
 	}
 
+	if r.SendProxyProtocol != "" {
+		if err := sendProxyProtocolHeader(conn, proxy, r.SendProxyProtocol); err != nil {
+			logVerbose(1, "Error sending PROXY protocol header:", err.Error())
+			_ = conn.Close()
+			_ = proxy.Close()
+			return
+		}
+	}
+
 	SimultaneousConnections.mu.Lock()
 	SimultaneousConnections.SimultaneousConnections[index] += 2 //Two is added; One for client to server and another for server to client
 	logVerbose(4, "Accepting a connection from", conn.RemoteAddr(), "; Now", SimultaneousConnections.SimultaneousConnections[index], "SimultaneousConnections")
 	SimultaneousConnections.mu.Unlock()
 
-	go copyIO(conn, proxy, index)
-	go copyIO(proxy, conn, index)
+	//ctx is shared by both directions so that once either one finishes (the
+	//connection pair is dead either way), the other stops blocking in
+	//throttle's WaitN instead of waiting out a delay that can no longer matter.
+	ctx, cancel := context.WithCancel(context.Background())
+	go copyIO(ctx, cancel, conn, proxy, index)
+	go copyIO(ctx, cancel, proxy, conn, index)
 }
 
-func copyIO(src, dest net.Conn, index int) {
+func copyIO(ctx context.Context, cancel context.CancelFunc, src, dest net.Conn, index int) {
 	defer src.Close()
 	defer dest.Close()
+	defer cancel()
 
 	var r int64 //r is the amount of bytes transferred
 	var err error
 
-	if EnableTimeOut {
-		r, err = copyBuffer(src, dest)
-	} else {
-		r, err = io.Copy(src, dest)
-	}
+	r, err = copyBuffer(ctx, src, dest, index, EnableTimeOut)
 
 	if err != nil {
 		if strings.Contains(err.Error(), "i/o timeout") {
@@ -245,8 +416,9 @@ func copyIO(src, dest net.Conn, index int) {
 
 	}
 
-	Rules.mu.Lock() //Lock to change the amount of data transferred
+	Rules.mu.Lock() //Lock to change the amount of data transferred and the matching ruleBytes slot
 	Rules.Rules[index].Quota -= r
+	atomic.AddInt64(&ruleBytes[index], r)
 	Rules.mu.Unlock()
 
 	SimultaneousConnections.mu.Lock()
@@ -255,20 +427,25 @@ func copyIO(src, dest net.Conn, index int) {
 	SimultaneousConnections.mu.Unlock()
 }
 
-func copyBuffer(dst, src net.Conn) (written int64, err error) {
+func copyBuffer(ctx context.Context, dst, src net.Conn, index int, enforceTimeout bool) (written int64, err error) {
 	buf := make([]byte, 32768)
 	for {
-		err = src.SetDeadline(time.Now().Add(TimeoutDuration))
-		if err != nil {
-			logVerbose(1, "cannot set timeout for src")
-			break
+		if enforceTimeout {
+			err = src.SetDeadline(time.Now().Add(TimeoutDuration))
+			if err != nil {
+				logVerbose(1, "cannot set timeout for src")
+				break
+			}
 		}
 		nr, er := src.Read(buf)
 		if nr > 0 {
-			err = dst.SetDeadline(time.Now().Add(TimeoutDuration))
-			if err != nil {
-				logVerbose(1, "cannot set timeout for dest")
-				break
+			throttle(ctx, index, nr)
+			if enforceTimeout {
+				err = dst.SetDeadline(time.Now().Add(TimeoutDuration))
+				if err != nil {
+					logVerbose(1, "cannot set timeout for dest")
+					break
+				}
 			}
 			nw, ew := dst.Write(buf[0:nr])
 			if nw > 0 {
@@ -295,6 +472,6 @@ func copyBuffer(dst, src net.Conn) (written int64, err error) {
 
 func logVerbose(level int, msg ...interface{}) {
 	if Verbose >= level {
-		log.Println(msg)
+		log.Println(msg...)
 	}
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//proxyProtocolV2Signature is the fixed 12-byte magic every PROXY protocol v2 header starts with.
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+//sendProxyProtocolHeader writes a PROXY protocol v1 or v2 header to proxy,
+//describing conn's original client and accept addresses, before any of the
+//real payload is relayed.
+func sendProxyProtocolHeader(conn, proxy net.Conn, version string) error {
+	srcAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("PROXY protocol requires a TCP source address")
+	}
+	dstAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("PROXY protocol requires a TCP destination address")
+	}
+
+	switch version {
+	case "v1":
+		return writeProxyProtocolV1(proxy, srcAddr, dstAddr)
+	case "v2":
+		return writeProxyProtocolV2(proxy, srcAddr, dstAddr)
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %q", version)
+	}
+}
+
+func writeProxyProtocolV1(dst net.Conn, src, dest *net.TCPAddr) error {
+	proto := "TCP4"
+	if src.IP.To4() == nil {
+		proto = "TCP6"
+	}
+	header := fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src.IP.String(), dest.IP.String(), src.Port, dest.Port)
+	_, err := dst.Write([]byte(header))
+	return err
+}
+
+func writeProxyProtocolV2(dst net.Conn, src, dest *net.TCPAddr) error {
+	var addrFamily byte
+	var addrBytes []byte
+
+	if src4, dest4 := src.IP.To4(), dest.IP.To4(); src4 != nil && dest4 != nil {
+		addrFamily = 0x11 // AF_INET, STREAM
+		addrBytes = make([]byte, 12)
+		copy(addrBytes[0:4], src4)
+		copy(addrBytes[4:8], dest4)
+		binary.BigEndian.PutUint16(addrBytes[8:10], uint16(src.Port))
+		binary.BigEndian.PutUint16(addrBytes[10:12], uint16(dest.Port))
+	} else {
+		addrFamily = 0x21 // AF_INET6, STREAM
+		addrBytes = make([]byte, 36)
+		copy(addrBytes[0:16], src.IP.To16())
+		copy(addrBytes[16:32], dest.IP.To16())
+		binary.BigEndian.PutUint16(addrBytes[32:34], uint16(src.Port))
+		binary.BigEndian.PutUint16(addrBytes[34:36], uint16(dest.Port))
+	}
+
+	header := make([]byte, 0, len(proxyProtocolV2Signature)+4+len(addrBytes))
+	header = append(header, proxyProtocolV2Signature...)
+	header = append(header, 0x21) // version 2, command PROXY
+	header = append(header, addrFamily)
+	lenBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(addrBytes)))
+	header = append(header, lenBuf...)
+	header = append(header, addrBytes...)
+
+	_, err := dst.Write(header)
+	return err
+}
+
+//proxyProtocolConn wraps an accepted connection so RemoteAddr() reports the
+//real client address extracted from a leading PROXY protocol header instead
+//of the address of the upstream load balancer that relayed it.
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) { return c.reader.Read(b) }
+func (c *proxyProtocolConn) RemoteAddr() net.Addr       { return c.remoteAddr }
+
+//acceptProxyProtocolHeader reads a PROXY protocol v1 or v2 header off conn
+//and returns a connection whose RemoteAddr() reflects the real client. On
+//any error conn is closed before returning.
+func acceptProxyProtocolHeader(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+
+	prefix, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytes.Equal(prefix, proxyProtocolV2Signature) {
+		return parseProxyProtocolV2(conn, reader)
+	}
+
+	prefix, err = reader.Peek(6)
+	if err == nil && string(prefix) == "PROXY " {
+		return parseProxyProtocolV1(conn, reader)
+	}
+
+	_ = conn.Close()
+	return nil, errors.New("missing or unrecognized PROXY protocol header")
+}
+
+func parseProxyProtocolV1(conn net.Conn, reader *bufio.Reader) (net.Conn, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	fields := strings.Fields(strings.TrimSpace(line))
+	if len(fields) != 6 || fields[0] != "PROXY" {
+		_ = conn.Close()
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header: %q", line)
+	}
+
+	srcPort, err := strconv.Atoi(fields[4])
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &proxyProtocolConn{
+		Conn:       conn,
+		reader:     reader,
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP(fields[2]), Port: srcPort},
+	}, nil
+}
+
+func parseProxyProtocolV2(conn net.Conn, reader *bufio.Reader) (net.Conn, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	addrFamily := header[13]
+	addrLen := binary.BigEndian.Uint16(header[14:16])
+	addrBytes := make([]byte, addrLen)
+	if _, err := io.ReadFull(reader, addrBytes); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	var ip net.IP
+	var port int
+	switch addrFamily {
+	case 0x11: // AF_INET
+		if len(addrBytes) < 12 {
+			_ = conn.Close()
+			return nil, errors.New("malformed PROXY protocol v2 IPv4 address block")
+		}
+		ip = net.IP(addrBytes[0:4])
+		port = int(binary.BigEndian.Uint16(addrBytes[8:10]))
+	case 0x21: // AF_INET6
+		if len(addrBytes) < 36 {
+			_ = conn.Close()
+			return nil, errors.New("malformed PROXY protocol v2 IPv6 address block")
+		}
+		ip = net.IP(addrBytes[0:16])
+		port = int(binary.BigEndian.Uint16(addrBytes[32:34]))
+	default:
+		_ = conn.Close()
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 address family %#x", addrFamily)
+	}
+
+	return &proxyProtocolConn{
+		Conn:       conn,
+		reader:     reader,
+		remoteAddr: &net.TCPAddr{IP: ip, Port: port},
+	}, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+//pipeConn returns one end of a net.Pipe with data already written down the
+//other end, so parseProxyProtocolV1/V2 can read it back through a
+//bufio.Reader the same way acceptProxyProtocolHeader would hand it one.
+func pipeConn(t *testing.T, data []byte) net.Conn {
+	t.Helper()
+	server, client := net.Pipe()
+	go func() {
+		_, _ = client.Write(data)
+		_ = client.Close()
+	}()
+	t.Cleanup(func() { _ = server.Close() })
+	return server
+}
+
+func TestParseProxyProtocolV1(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantErr  bool
+		wantIP   string
+		wantPort int
+	}{
+		{name: "valid TCP4", line: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", wantIP: "192.0.2.1", wantPort: 56324},
+		{name: "valid TCP6", line: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", wantIP: "2001:db8::1", wantPort: 56324},
+		{name: "wrong field count", line: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", wantErr: true},
+		{name: "not a PROXY line", line: "GET / HTTP/1.1\r\n", wantErr: true},
+		{name: "non-numeric port", line: "PROXY TCP4 192.0.2.1 198.51.100.1 notaport 443\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := pipeConn(t, []byte(tt.line))
+			reader := bufio.NewReader(conn)
+			got, err := parseProxyProtocolV1(conn, reader)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			addr, ok := got.RemoteAddr().(*net.TCPAddr)
+			if !ok {
+				t.Fatalf("RemoteAddr() is not a *net.TCPAddr: %#v", got.RemoteAddr())
+			}
+			if addr.IP.String() != tt.wantIP || addr.Port != tt.wantPort {
+				t.Fatalf("got %s:%d, want %s:%d", addr.IP, addr.Port, tt.wantIP, tt.wantPort)
+			}
+		})
+	}
+}
+
+//buildProxyProtocolV2 assembles a v2 header for addrFamily (0x11 AF_INET or
+//0x21 AF_INET6) with addrBytes as the address block, letting tests also pass
+//a too-short addrBytes to exercise the truncation checks.
+func buildProxyProtocolV2(addrFamily byte, addrBytes []byte) []byte {
+	header := make([]byte, 0, len(proxyProtocolV2Signature)+4+len(addrBytes))
+	header = append(header, proxyProtocolV2Signature...)
+	header = append(header, 0x21) // version 2, command PROXY
+	header = append(header, addrFamily)
+	lenBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(addrBytes)))
+	header = append(header, lenBuf...)
+	return append(header, addrBytes...)
+}
+
+func TestParseProxyProtocolV2(t *testing.T) {
+	ipv4 := make([]byte, 12)
+	copy(ipv4[0:4], net.ParseIP("192.0.2.1").To4())
+	copy(ipv4[4:8], net.ParseIP("198.51.100.1").To4())
+	binary.BigEndian.PutUint16(ipv4[8:10], 56324)
+	binary.BigEndian.PutUint16(ipv4[10:12], 443)
+
+	ipv6 := make([]byte, 36)
+	copy(ipv6[0:16], net.ParseIP("2001:db8::1").To16())
+	copy(ipv6[16:32], net.ParseIP("2001:db8::2").To16())
+	binary.BigEndian.PutUint16(ipv6[32:34], 56324)
+	binary.BigEndian.PutUint16(ipv6[34:36], 443)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantErr  bool
+		wantIP   string
+		wantPort int
+	}{
+		{name: "valid AF_INET", data: buildProxyProtocolV2(0x11, ipv4), wantIP: "192.0.2.1", wantPort: 56324},
+		{name: "valid AF_INET6", data: buildProxyProtocolV2(0x21, ipv6), wantIP: "2001:db8::1", wantPort: 56324},
+		{name: "unsupported address family", data: buildProxyProtocolV2(0x00, ipv4), wantErr: true},
+		{name: "truncated AF_INET block", data: buildProxyProtocolV2(0x11, ipv4[:4]), wantErr: true},
+		{name: "truncated AF_INET6 block", data: buildProxyProtocolV2(0x21, ipv6[:4]), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := pipeConn(t, tt.data)
+			reader := bufio.NewReader(conn)
+			got, err := parseProxyProtocolV2(conn, reader)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			addr, ok := got.RemoteAddr().(*net.TCPAddr)
+			if !ok {
+				t.Fatalf("RemoteAddr() is not a *net.TCPAddr: %#v", got.RemoteAddr())
+			}
+			if addr.IP.String() != tt.wantIP || addr.Port != tt.wantPort {
+				t.Fatalf("got %s:%d, want %s:%d", addr.IP, addr.Port, tt.wantIP, tt.wantPort)
+			}
+		})
+	}
+}
+
+//TestAcceptProxyProtocolHeaderUnrecognized checks that acceptProxyProtocolHeader
+//rejects a connection whose first bytes are neither a v1 nor a v2 PROXY header.
+//The read deadline only keeps the test from blocking if a read never returns.
+func TestAcceptProxyProtocolHeaderUnrecognized(t *testing.T) {
+	conn := pipeConn(t, []byte("not a proxy header at all"))
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := acceptProxyProtocolHeader(conn); err == nil {
+		t.Fatal("expected an error for an unrecognized header")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+)
+
+//bufferedConn lets a peeked bufio.Reader be handed off as a plain net.Conn,
+//so bytes already consumed to inspect a connection (e.g. a ClientHello) are
+//replayed to whatever reads from it next.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.reader.Read(b) }
+
+//loadRuleTLSConfig loads rule's certificate/key once so startRule doesn't
+//re-read them from disk on every accepted connection.
+func loadRuleTLSConfig(rule Rule) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(rule.TLSCert, rule.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+//resolveSNIRoute peeks the ClientHello off conn to read its server_name
+//extension, without decrypting anything, and resolves it against
+//rule.SNIRoutes (falling back to rule.DefaultForward). It returns a
+//connection that still contains the peeked ClientHello bytes so they can be
+//spliced to the backend along with everything that follows.
+func resolveSNIRoute(conn net.Conn, rule Rule) (net.Conn, string, error) {
+	reader := bufio.NewReader(conn)
+
+	//We don't know the ClientHello's length up front, so peek progressively
+	//larger chunks until we have the whole thing or hit a sane cap.
+	const maxClientHello = 16384
+	var hello []byte
+	for size := 2048; ; size *= 2 {
+		if size > maxClientHello {
+			size = maxClientHello
+		}
+		buf, err := reader.Peek(size)
+		hello = buf
+		if len(buf) < size || size == maxClientHello {
+			if err != nil && len(buf) == 0 {
+				_ = conn.Close()
+				return nil, "", err
+			}
+			break
+		}
+	}
+
+	hostname, err := extractSNI(hello)
+	if err != nil {
+		_ = conn.Close()
+		return nil, "", err
+	}
+
+	forward, ok := rule.SNIRoutes[hostname]
+	if !ok {
+		forward = rule.DefaultForward
+	}
+	if forward == "" {
+		_ = conn.Close()
+		return nil, "", fmt.Errorf("no SNI route for %q and no DefaultForward configured", hostname)
+	}
+
+	return &bufferedConn{Conn: conn, reader: reader}, forward, nil
+}
+
+//extractSNI parses just enough of a TLS record and ClientHello to read the
+//server_name extension, per RFC 8446 section 4.1.2/4.2.11's wire layout.
+func extractSNI(data []byte) (string, error) {
+	if len(data) < 5 || data[0] != 0x16 {
+		return "", errors.New("not a TLS handshake record")
+	}
+	pos := 5
+	if pos+4 > len(data) || data[pos] != 0x01 {
+		return "", errors.New("not a ClientHello")
+	}
+
+	helloLen := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+	pos += 4
+	end := pos + helloLen
+	if end > len(data) {
+		end = len(data)
+	}
+
+	pos += 2 + 32 // client_version + random
+	if pos >= end {
+		return "", errors.New("truncated ClientHello")
+	}
+
+	sessionIDLen := int(data[pos])
+	pos += 1 + sessionIDLen
+	if pos+2 > end {
+		return "", errors.New("truncated ClientHello")
+	}
+
+	cipherSuitesLen := int(data[pos])<<8 | int(data[pos+1])
+	pos += 2 + cipherSuitesLen
+	if pos+1 > end {
+		return "", errors.New("truncated ClientHello")
+	}
+
+	compressionMethodsLen := int(data[pos])
+	pos += 1 + compressionMethodsLen
+	if pos+2 > end {
+		return "", errors.New("ClientHello has no extensions")
+	}
+
+	extensionsLen := int(data[pos])<<8 | int(data[pos+1])
+	pos += 2
+	extensionsEnd := pos + extensionsLen
+	if extensionsEnd > end {
+		extensionsEnd = end
+	}
+
+	for pos+4 <= extensionsEnd {
+		extType := int(data[pos])<<8 | int(data[pos+1])
+		extLen := int(data[pos+2])<<8 | int(data[pos+3])
+		pos += 4
+		if pos+extLen > extensionsEnd {
+			break
+		}
+		if extType == 0x0000 { // server_name
+			return parseServerNameExtension(data[pos : pos+extLen])
+		}
+		pos += extLen
+	}
+
+	return "", errors.New("ClientHello has no server_name extension")
+}
+
+func parseServerNameExtension(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", errors.New("malformed server_name extension")
+	}
+	listLen := int(data[0])<<8 | int(data[1])
+	pos := 2
+	end := pos + listLen
+	if end > len(data) {
+		end = len(data)
+	}
+
+	for pos+3 <= end {
+		nameType := data[pos]
+		nameLen := int(data[pos+1])<<8 | int(data[pos+2])
+		pos += 3
+		if pos+nameLen > end {
+			break
+		}
+		if nameType == 0 { // host_name
+			return string(data[pos : pos+nameLen]), nil
+		}
+		pos += nameLen
+	}
+
+	return "", errors.New("server_name extension has no host_name entry")
+}
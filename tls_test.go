@@ -0,0 +1,113 @@
+package main
+
+import "testing"
+
+//buildClientHello assembles a minimal TLS 1.2-shaped ClientHello record
+//carrying a single server_name extension (none when serverName is empty),
+//mirroring just enough of RFC
+//8446 section 4.1.2/4.2.11 for extractSNI to parse.
+func buildClientHello(serverName string) []byte {
+	var sni []byte
+	if serverName != "" {
+		entry := append([]byte{0x00}, uint16Bytes(uint16(len(serverName)))...)
+		entry = append(entry, []byte(serverName)...)
+		sniList := append(uint16Bytes(uint16(len(entry))), entry...)
+		extBody := sniList
+		sni = append(uint16Bytes(0x0000), uint16Bytes(uint16(len(extBody)))...)
+		sni = append(sni, extBody...)
+	}
+
+	body := make([]byte, 0, 64)
+	body = append(body, 0x03, 0x03)             // client_version
+	body = append(body, make([]byte, 32)...)    // random
+	body = append(body, 0x00)                   // session id len = 0
+	body = append(body, 0x00, 0x02, 0x13, 0x01) // cipher suites len=2, one suite
+	body = append(body, 0x01, 0x00)             // compression methods len=1, method=0
+	body = append(body, uint16Bytes(uint16(len(sni)))...)
+	body = append(body, sni...)
+
+	handshake := make([]byte, 0, len(body)+4)
+	handshake = append(handshake, 0x01) // ClientHello
+	handshake = append(handshake, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+	handshake = append(handshake, body...)
+
+	record := make([]byte, 0, len(handshake)+5)
+	record = append(record, 0x16, 0x03, 0x01) // handshake record, version
+	record = append(record, uint16Bytes(uint16(len(handshake)))...)
+	record = append(record, handshake...)
+	return record
+}
+
+func uint16Bytes(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func TestExtractSNI(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "valid server name", data: buildClientHello("example.com"), want: "example.com"},
+		{name: "not a handshake record", data: []byte{0x17, 0x03, 0x01, 0x00, 0x00}, wantErr: true},
+		{name: "not a ClientHello", data: []byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00}, wantErr: true},
+		{name: "no server_name extension", data: buildClientHello(""), wantErr: true},
+		{name: "truncated ClientHello", data: buildClientHello("example.com")[:10], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractSNI(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseServerNameExtension(t *testing.T) {
+	valid := func(name string) []byte {
+		entry := append([]byte{0x00}, uint16Bytes(uint16(len(name)))...)
+		entry = append(entry, []byte(name)...)
+		return append(uint16Bytes(uint16(len(entry))), entry...)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "valid host_name entry", data: valid("example.com"), want: "example.com"},
+		{name: "too short to have a list length", data: []byte{0x00}, wantErr: true},
+		{name: "non host_name entry type", data: append(uint16Bytes(4), append([]byte{0x01}, append(uint16Bytes(1), 'x')...)...), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServerNameExtension(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Mode values
+const (
+	ModeDirect = "direct"
+	ModeServer = "server"
+	ModeClient = "client"
+)
+
+//controlFrame is sent by the server over a client's persistent control
+//connection to ask it to dial a rule's Forward and open a data connection.
+type controlFrame struct {
+	Type string // "new_conn"
+	Rule string // rule name the frame refers to
+	ID   string // connection id, matched against the follow-up data connection
+}
+
+//handshake is the first message exchanged on any tunnel connection (control
+//or data), authenticated with an HMAC of a server-issued nonce so the shared
+//Secret never goes over the wire in the clear.
+type handshake struct {
+	Sig   string   // HMAC-SHA256(Secret, nonce), hex encoded
+	Kind  string   // "control" or "data"
+	Rules []string // control only: names of the rules this client serves
+	ID    string   // data only: connection id this data connection answers
+}
+
+func signNonce(secret, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//controlLink is a client's control connection plus a write lock, since
+//several visitor connections for the same rule can ask to requestConnection
+//concurrently and their controlFrame writes must not interleave.
+type controlLink struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+//tunnelServer matches visitor connections accepted on Rule.Listen to the
+//client responsible for that rule, in Mode == ModeServer.
+type tunnelServer struct {
+	mu       sync.Mutex
+	controls map[string]*controlLink //rule name -> client's control connection
+	pending  map[string]chan net.Conn //connection id -> channel delivering the client's data connection
+}
+
+//Tunnel is the server-side bookkeeping used by handleRequest in server mode.
+var Tunnel = &tunnelServer{
+	controls: make(map[string]*controlLink),
+	pending:  make(map[string]chan net.Conn),
+}
+
+//startTunnelServer accepts control and data connections from clients behind
+//NAT on Config.ControlPort.
+func startTunnelServer(conf Config) {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(conf.ControlPort))
+	if err != nil {
+		panic(err)
+	}
+	log.Println("Listening for tunnel clients on control port", conf.ControlPort)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logVerbose(1, "Error accepting tunnel connection:", err.Error())
+			continue
+		}
+		go Tunnel.handleConnection(conn, conf.Secret)
+	}
+}
+
+func (t *tunnelServer) handleConnection(conn net.Conn, secret string) {
+	nonce := randomID()
+	if err := json.NewEncoder(conn).Encode(map[string]string{"nonce": nonce}); err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	var hs handshake
+	if err := json.NewDecoder(conn).Decode(&hs); err != nil || !hmac.Equal([]byte(hs.Sig), []byte(signNonce(secret, nonce))) {
+		logVerbose(1, "Rejecting tunnel connection from", conn.RemoteAddr(), "(bad auth)")
+		_ = conn.Close()
+		return
+	}
+
+	switch hs.Kind {
+	case "control":
+		t.registerControl(hs.Rules, conn)
+	case "data":
+		t.deliverData(hs.ID, conn)
+	default:
+		_ = conn.Close()
+	}
+}
+
+//registerControl keeps a client's control connection as long as it stays
+//open, and removes it once the client disconnects.
+func (t *tunnelServer) registerControl(rules []string, conn net.Conn) {
+	link := &controlLink{conn: conn}
+
+	t.mu.Lock()
+	for _, name := range rules {
+		t.controls[name] = link
+	}
+	t.mu.Unlock()
+	log.Println("Tunnel client registered for rules", rules)
+
+	//Block here until the client goes away; no further frames are expected
+	//to arrive from it on this connection.
+	buf := make([]byte, 1)
+	_, _ = conn.Read(buf)
+
+	t.mu.Lock()
+	for _, name := range rules {
+		if t.controls[name] == link {
+			delete(t.controls, name)
+		}
+	}
+	t.mu.Unlock()
+	_ = conn.Close()
+	log.Println("Tunnel client for rules", rules, "disconnected")
+}
+
+func (t *tunnelServer) deliverData(id string, conn net.Conn) {
+	t.mu.Lock()
+	ch, ok := t.pending[id]
+	t.mu.Unlock()
+	if !ok {
+		_ = conn.Close()
+		return
+	}
+	ch <- conn
+}
+
+//requestConnection asks the client that registered ruleName to dial its
+//local Forward and open a fresh data connection back, and blocks until that
+//connection arrives or the request times out.
+func (t *tunnelServer) requestConnection(ruleName string) (net.Conn, error) {
+	t.mu.Lock()
+	control, ok := t.controls[ruleName]
+	if !ok {
+		t.mu.Unlock()
+		return nil, errors.New("no tunnel client registered for rule " + ruleName)
+	}
+	id := randomID()
+	ch := make(chan net.Conn, 1)
+	t.pending[id] = ch
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+	}()
+
+	control.writeMu.Lock()
+	err := json.NewEncoder(control.conn).Encode(controlFrame{Type: "new_conn", Rule: ruleName, ID: id})
+	control.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case conn := <-ch:
+		return conn, nil
+	case <-time.After(10 * time.Second):
+		return nil, errors.New("timed out waiting for tunnel client to dial back")
+	}
+}
+
+//startTunnelClient dials the server's control port, registers every rule
+//this instance serves locally, then waits for the server to ask for fresh
+//data connections.
+func startTunnelClient(conf Config) {
+	control, sig, err := dialAndAuthenticate(conf.ServerAddress, conf.ControlPort, conf.Secret)
+	if err != nil {
+		panic("Cannot connect to tunnel server: " + err.Error())
+	}
+
+	names := make([]string, len(conf.Rules))
+	for i, rule := range conf.Rules {
+		names[i] = rule.Name
+	}
+	if err := json.NewEncoder(control).Encode(handshake{Sig: sig, Kind: "control", Rules: names}); err != nil {
+		panic("Cannot register rules with tunnel server: " + err.Error())
+	}
+	log.Println("Connected to tunnel server at", conf.ServerAddress, "serving rules", names)
+
+	rulesByName := make(map[string]Rule, len(conf.Rules))
+	for _, rule := range conf.Rules {
+		rulesByName[rule.Name] = rule
+	}
+
+	dec := json.NewDecoder(control)
+	for {
+		var frame controlFrame
+		if err := dec.Decode(&frame); err != nil {
+			panic("Lost connection to tunnel server: " + err.Error())
+		}
+		rule, ok := rulesByName[frame.Rule]
+		if !ok {
+			logVerbose(1, "Tunnel server asked for unknown rule", frame.Rule)
+			continue
+		}
+		go serveTunnelConnection(conf, frame.ID, rule)
+	}
+}
+
+//serveTunnelConnection dials the rule's local Forward, opens a matching data
+//connection back to the server and splices the two together.
+func serveTunnelConnection(conf Config, id string, rule Rule) {
+	local, err := net.Dial("tcp", rule.Forward)
+	if err != nil {
+		logVerbose(1, "Error dialing local forward", rule.Forward, ":", err.Error())
+		return
+	}
+
+	data, sig, err := dialAndAuthenticate(conf.ServerAddress, conf.ControlPort, conf.Secret)
+	if err != nil {
+		logVerbose(1, "Error opening data connection to tunnel server:", err.Error())
+		_ = local.Close()
+		return
+	}
+	if err := json.NewEncoder(data).Encode(handshake{Sig: sig, Kind: "data", ID: id}); err != nil {
+		logVerbose(1, "Error sending data handshake:", err.Error())
+		_ = local.Close()
+		_ = data.Close()
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(local, data)
+		_ = local.Close()
+	}()
+	_, _ = io.Copy(data, local)
+	_ = data.Close()
+}
+
+//dialAndAuthenticate connects to the tunnel server and completes the nonce
+//challenge, returning the open connection and the signature to present in
+//the handshake the caller sends next.
+func dialAndAuthenticate(address string, controlPort int, secret string) (net.Conn, string, error) {
+	conn, err := net.Dial("tcp", address+":"+strconv.Itoa(controlPort))
+	if err != nil {
+		return nil, "", err
+	}
+	var challenge struct{ Nonce string }
+	if err := json.NewDecoder(conn).Decode(&challenge); err != nil {
+		_ = conn.Close()
+		return nil, "", err
+	}
+	return conn, signNonce(secret, challenge.Nonce), nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//ruleWantsTCP and ruleWantsUDP decide which listeners startRule/startUDPRule
+//set up for a rule, based on its Protocol field.
+func ruleWantsTCP(rule Rule) bool {
+	return rule.Protocol == "" || rule.Protocol == "tcp" || rule.Protocol == "both"
+}
+
+func ruleWantsUDP(rule Rule) bool {
+	return rule.Protocol == "udp" || rule.Protocol == "both"
+}
+
+//warnIfProtocolUnrecognized logs when rule.Protocol matches neither
+//ruleWantsTCP nor ruleWantsUDP, since that silently leaves the rule with no
+//listener at all instead of the case typo it usually is.
+func warnIfProtocolUnrecognized(rule Rule) {
+	if !ruleWantsTCP(rule) && !ruleWantsUDP(rule) {
+		logVerbose(1, "Rule", rule.Name, "has unrecognized Protocol", fmt.Sprintf("%q", rule.Protocol), "; no listener was started for it")
+	}
+}
+
+//udpSession is one client<->upstream relay for a UDP rule.
+type udpSession struct {
+	upstream *net.UDPConn
+	mu       sync.Mutex
+	lastSeen time.Time
+}
+
+//udpSessions holds the live sessions per rule, keyed by the client's address
+//string, indexed like Rules.Rules.
+var udpSessions = make(map[int]map[string]*udpSession)
+var udpSessionsMu sync.Mutex
+
+//startUDPRule listens for UDP datagrams on rule.Listen and relays them to
+//rule.Forward, keeping one upstream session per client address until it goes
+//idle for TimeoutDuration.
+func startUDPRule(ctx context.Context, index int, rule Rule) {
+	pc, err := net.ListenPacket("udp", ":"+strconv.Itoa(int(rule.Listen)))
+	if err != nil {
+		logVerbose(1, "Error starting UDP listener for rule", rule.Name, ":", err.Error())
+		return
+	}
+
+	udpSessionsMu.Lock()
+	udpSessions[index] = make(map[string]*udpSession)
+	udpSessionsMu.Unlock()
+
+	go func() { //Closing the socket is what makes ReadFrom below return once ctx is cancelled
+		<-ctx.Done()
+		_ = pc.Close()
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, clientAddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logVerbose(4, "Error reading UDP datagram for rule", rule.Name, ":", err.Error())
+			continue
+		}
+
+		Rules.mu.RLock()
+		quotaOk := Rules.Rules[index].Quota >= 0
+		Rules.mu.RUnlock()
+		if !quotaOk {
+			logVerbose(1, "Quota reached for UDP rule", rule.Name, ", dropping datagram")
+			continue
+		}
+
+		session := getOrCreateUDPSession(index, rule, pc, clientAddr)
+		if session == nil {
+			continue
+		}
+
+		session.mu.Lock()
+		_, err = session.upstream.Write(buf[:n])
+		session.lastSeen = time.Now()
+		session.mu.Unlock()
+		if err != nil {
+			logVerbose(4, "Error writing to UDP upstream for rule", rule.Name, ":", err.Error())
+			continue
+		}
+
+		Rules.mu.Lock()
+		Rules.Rules[index].Quota -= int64(n)
+		Rules.mu.Unlock()
+		atomic.AddInt64(&ruleBytes[index], int64(n))
+	}
+}
+
+func getOrCreateUDPSession(index int, rule Rule, pc net.PacketConn, clientAddr net.Addr) *udpSession {
+	key := clientAddr.String()
+
+	udpSessionsMu.Lock()
+	sessions := udpSessions[index]
+	if session, ok := sessions[key]; ok {
+		udpSessionsMu.Unlock()
+		return session
+	}
+	udpSessionsMu.Unlock()
+
+	Rules.mu.RLock()
+	simultaneous := Rules.Rules[index].Simultaneous //rule is the listener's startup copy; read the live limit so PATCH applies
+	Rules.mu.RUnlock()
+	if simultaneous != 0 {
+		SimultaneousConnections.mu.RLock()
+		full := SimultaneousConnections.SimultaneousConnections[index] >= (simultaneous * 2)
+		SimultaneousConnections.mu.RUnlock()
+		if full {
+			logVerbose(2, "Blocking new UDP session for rule", rule.Name, "because the connection limit is reached")
+			return nil
+		}
+	}
+
+	upstream, err := net.Dial("udp", rule.Forward)
+	if err != nil {
+		logVerbose(1, "Error dialing UDP upstream", rule.Forward, "for rule", rule.Name, ":", err.Error())
+		return nil
+	}
+
+	session := &udpSession{upstream: upstream.(*net.UDPConn), lastSeen: time.Now()}
+
+	udpSessionsMu.Lock()
+	udpSessions[index][key] = session
+	udpSessionsMu.Unlock()
+
+	SimultaneousConnections.mu.Lock()
+	SimultaneousConnections.SimultaneousConnections[index] += 2 //Same scale as TCP, which counts each direction separately
+	logVerbose(4, "New UDP session from", clientAddr, "for rule", rule.Name)
+	SimultaneousConnections.mu.Unlock()
+
+	go relayUDPReplies(index, rule, key, session, pc, clientAddr)
+	go expireUDPSessionOnIdle(index, key, session)
+
+	return session
+}
+
+//relayUDPReplies copies datagrams coming back from the upstream to the
+//original client address until the upstream connection is closed, which
+//expireUDPSessionOnIdle does once the session goes idle.
+func relayUDPReplies(index int, rule Rule, key string, session *udpSession, pc net.PacketConn, clientAddr net.Addr) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := session.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := pc.WriteTo(buf[:n], clientAddr); err != nil {
+			return
+		}
+
+		session.mu.Lock()
+		session.lastSeen = time.Now()
+		session.mu.Unlock()
+
+		Rules.mu.Lock()
+		Rules.Rules[index].Quota -= int64(n)
+		Rules.mu.Unlock()
+		atomic.AddInt64(&ruleBytes[index], int64(n))
+	}
+}
+
+//expireUDPSessionOnIdle tears the session down once it has been idle for
+//TimeoutDuration. With timeouts disabled globally, sessions are never
+//expired; stopping the rule's listener does not close them either.
+func expireUDPSessionOnIdle(index int, key string, session *udpSession) {
+	if !EnableTimeOut {
+		return
+	}
+
+	for {
+		session.mu.Lock()
+		idle := time.Since(session.lastSeen)
+		session.mu.Unlock()
+		if idle >= TimeoutDuration {
+			break
+		}
+		time.Sleep(TimeoutDuration - idle)
+	}
+
+	udpSessionsMu.Lock()
+	delete(udpSessions[index], key)
+	udpSessionsMu.Unlock()
+
+	_ = session.upstream.Close()
+
+	SimultaneousConnections.mu.Lock()
+	SimultaneousConnections.SimultaneousConnections[index] -= 2
+	SimultaneousConnections.mu.Unlock()
+	logVerbose(3, "UDP session", key, "idle-timed-out")
+}